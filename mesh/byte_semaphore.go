@@ -0,0 +1,68 @@
+package mesh
+
+import (
+	"errors"
+	"sync"
+)
+
+// ErrGossipBufferFull is returned by GossipUnicast/GossipBroadcast (and by
+// the underlying gossip senders) when a message is larger than the
+// gossip memory budget (global or per-peer) could ever accommodate. While
+// the budget is merely full, senders block until space is given back
+// rather than returning this error.
+var ErrGossipBufferFull = errors.New("gossip buffer full")
+
+// DefaultMaxGossipBufferBytes is the default total amount of gossip
+// payload memory that may be buffered in-flight (queued but not yet
+// handed to a connection writer) across all peers of one channel: it is
+// the size of the buffer limiter that NewGossipChannel and
+// NewGossipChannelWithDescriptor give each channel. No Router.Config
+// field overrides it.
+const DefaultMaxGossipBufferBytes = 256 * 1024 * 1024
+
+// DefaultMaxGossipPeerBufferBytes is the default per-peer sub-limit
+// within a channel's buffer budget, used so that a single slow or dead
+// connection cannot starve every other peer of buffer space.
+const DefaultMaxGossipPeerBufferBytes = 32 * 1024 * 1024
+
+// byteSemaphore is a counting semaphore over a number of bytes, used to
+// bound the total size of gossip payloads buffered in memory at once.
+// Unlike a plain condition-variable wait, take fails fast with
+// ErrGossipBufferFull when n alone can never fit within max, rather than
+// blocking forever.
+type byteSemaphore struct {
+	max       uint
+	available uint
+	mutex     sync.Mutex
+	cond      *sync.Cond
+}
+
+func newByteSemaphore(max uint) *byteSemaphore {
+	s := &byteSemaphore{max: max, available: max}
+	s.cond = sync.NewCond(&s.mutex)
+	return s
+}
+
+// take blocks until n bytes are available and reserves them, unless n is
+// larger than the semaphore's max, in which case it returns
+// ErrGossipBufferFull immediately since the request could never succeed.
+func (s *byteSemaphore) take(n uint) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if n > s.max {
+		return ErrGossipBufferFull
+	}
+	for n > s.available {
+		s.cond.Wait()
+	}
+	s.available -= n
+	return nil
+}
+
+// give releases n bytes previously reserved with take.
+func (s *byteSemaphore) give(n uint) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.available += n
+	s.cond.Broadcast()
+}
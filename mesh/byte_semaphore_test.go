@@ -0,0 +1,63 @@
+package mesh
+
+import (
+	"testing"
+	"time"
+)
+
+func TestByteSemaphoreTakeGive(t *testing.T) {
+	s := newByteSemaphore(10)
+	if err := s.take(10); err != nil {
+		t.Fatalf("take(10) on a semaphore of size 10: %v", err)
+	}
+	done := make(chan struct{})
+	go func() {
+		if err := s.take(1); err != nil {
+			t.Errorf("take(1) after give: %v", err)
+		}
+		close(done)
+	}()
+	select {
+	case <-done:
+		t.Fatal("take(1) returned before the semaphore had any bytes available")
+	case <-time.After(20 * time.Millisecond):
+	}
+	s.give(1)
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("take(1) did not unblock after give(1)")
+	}
+}
+
+func TestByteSemaphoreFailsFastWhenRequestExceedsMax(t *testing.T) {
+	s := newByteSemaphore(10)
+	if err := s.take(11); err != ErrGossipBufferFull {
+		t.Fatalf("take(11) on a semaphore of size 10 = %v, want ErrGossipBufferFull", err)
+	}
+}
+
+func TestByteSemaphoreGiveUnblocksOnlyOneWaiterAtATime(t *testing.T) {
+	s := newByteSemaphore(1)
+	if err := s.take(1); err != nil {
+		t.Fatal(err)
+	}
+	results := make(chan error, 2)
+	for i := 0; i < 2; i++ {
+		go func() { results <- s.take(1) }()
+	}
+	time.Sleep(20 * time.Millisecond)
+	s.give(1)
+	if err := <-results; err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case err := <-results:
+		t.Fatalf("second take(1) returned (%v) before its byte was given back", err)
+	case <-time.After(20 * time.Millisecond):
+	}
+	s.give(1)
+	if err := <-results; err != nil {
+		t.Fatal(err)
+	}
+}
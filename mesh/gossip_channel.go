@@ -2,32 +2,194 @@ package mesh
 
 import (
 	"bytes"
+	"encoding/binary"
 	"encoding/gob"
 	"fmt"
 	"sync"
+
+	"github.com/defconcepts/weave/mesh/wire"
+)
+
+// GossipPriority selects which of a peerGossipSender's queues a channel's
+// traffic is placed in. Higher-priority queues are drained more often and
+// are the last to have entries dropped when a peer falls behind. Each
+// channel has its own sender on each connection and queues all of its
+// traffic at its one priority, so priorities are not weighed against
+// other channels' traffic on the same connection.
+type GossipPriority int
+
+const (
+	// PriorityHigh is for small, latency-sensitive control traffic such
+	// as topology gossip.
+	PriorityHigh GossipPriority = iota
+	// PriorityNormal is for ordinary broadcasts.
+	PriorityNormal
+	// PriorityBulk is for large, infrequent full-state deliveries.
+	PriorityBulk
 )
 
+func (p GossipPriority) String() string {
+	switch p {
+	case PriorityHigh:
+		return "high"
+	case PriorityNormal:
+		return "normal"
+	case PriorityBulk:
+		return "bulk"
+	default:
+		return "unknown"
+	}
+}
+
+// numPriorities is the number of distinct GossipPriority levels.
+const numPriorities = int(PriorityBulk) + 1
+
+// weightedDrainOrder lists, for one round of draining a peer's queues, how
+// many messages to take from each priority before moving to the next. This
+// gives high-priority traffic more of the connection's attention without
+// starving lower priorities outright.
+var weightedDrainOrder = [numPriorities]int{4, 2, 1}
+
+// ChannelDescriptor is declared by a Gossiper when it registers a
+// GossipChannel. It controls how that channel's traffic is scheduled and
+// bounded on each outgoing connection.
+type ChannelDescriptor struct {
+	// Priority selects the queue this channel's messages are placed in
+	// within this channel's sender for each connection; it is not weighed
+	// against other channels' queues on the same connection.
+	Priority GossipPriority
+	// QueueCapacity is the maximum number of pending messages buffered
+	// per peer before older entries are dropped.
+	QueueCapacity int
+	// MaxQueueBytes is the maximum number of encoded bytes buffered per
+	// peer for this channel before older entries are dropped.
+	MaxQueueBytes int
+	// DisableCompression opts this channel's payloads out of LZ4
+	// compression, for Gossipers (e.g. ones gossiping already-compressed
+	// blobs) where compressing again would just waste CPU.
+	DisableCompression bool
+}
+
+// defaultChannelDescriptor is used by callers that have not yet been
+// updated to declare one explicitly.
+var defaultChannelDescriptor = ChannelDescriptor{
+	Priority:      PriorityNormal,
+	QueueCapacity: 1024,
+	MaxQueueBytes: 10 * 1024 * 1024,
+}
+
 type GossipChannel struct {
 	sync.Mutex
-	name     string
-	ourself  *LocalPeer
-	routes   *Routes
-	gossiper Gossiper
-	senders  connectionSenders
+	name          string
+	ourself       *LocalPeer
+	routes        *Routes
+	gossiper      Gossiper
+	descriptor    ChannelDescriptor
+	senders       connectionSenders
+	bufferLimiter *byteSemaphore
+	peerBufferMax uint
+	peerLimiters  map[Connection]*byteSemaphore
 }
 
-type connectionSenders map[Connection]*GossipSender
+type connectionSenders map[Connection]*peerGossipSender
 
 func NewGossipChannel(channelName string, ourself *LocalPeer, routes *Routes, g Gossiper) *GossipChannel {
+	return NewGossipChannelWithDescriptor(channelName, ourself, routes, g, defaultChannelDescriptor)
+}
+
+// NewGossipChannelWithDescriptor is like NewGossipChannel but lets the
+// caller control how this channel's traffic is prioritised and bounded on
+// each connection it is sent over. It gives this channel a buffer limiter
+// of its own, of DefaultMaxGossipBufferBytes, with a per-peer sub-limit
+// of DefaultMaxGossipPeerBufferBytes; use NewGossipChannelWithLimits to
+// share one limiter across channels.
+func NewGossipChannelWithDescriptor(channelName string, ourself *LocalPeer, routes *Routes, g Gossiper, descriptor ChannelDescriptor) *GossipChannel {
+	return NewGossipChannelWithLimits(channelName, ourself, routes, g, descriptor,
+		newByteSemaphore(DefaultMaxGossipBufferBytes), DefaultMaxGossipPeerBufferBytes)
+}
+
+// NewGossipChannelWithLimits is like NewGossipChannelWithDescriptor but
+// additionally takes the *byteSemaphore that bounds in-flight gossip
+// memory. Passing the same bufferLimiter to several channels makes the
+// bound apply to all of them together; channels created through
+// NewGossipChannel or NewGossipChannelWithDescriptor each have their own.
+// peerBufferMax bounds how much of that budget any one peer may hold at
+// once on this channel.
+func NewGossipChannelWithLimits(channelName string, ourself *LocalPeer, routes *Routes, g Gossiper, descriptor ChannelDescriptor, bufferLimiter *byteSemaphore, peerBufferMax uint) *GossipChannel {
 	return &GossipChannel{
-		name:     channelName,
-		ourself:  ourself,
-		routes:   routes,
-		gossiper: g,
-		senders:  make(connectionSenders)}
+		name:          channelName,
+		ourself:       ourself,
+		routes:        routes,
+		gossiper:      g,
+		descriptor:    descriptor,
+		senders:       make(connectionSenders),
+		bufferLimiter: bufferLimiter,
+		peerBufferMax: peerBufferMax,
+		peerLimiters:  make(map[Connection]*byteSemaphore),
+	}
+}
+
+// gossipFrameReader decodes the fields that follow channelName/srcName in
+// a gossip frame: the relay destination (unicast only) and the payload
+// itself. gobFrameReader implements this over the legacy gob stream;
+// wireFrameReader implements it over a decoded mesh/wire frame.
+type gossipFrameReader interface {
+	DecodeDestName() (PeerName, error)
+	DecodePayload() ([]byte, error)
+}
+
+type gobFrameReader struct{ dec *gob.Decoder }
+
+func (r gobFrameReader) DecodeDestName() (PeerName, error) {
+	var name PeerName
+	err := r.dec.Decode(&name)
+	return name, err
+}
+
+func (r gobFrameReader) DecodePayload() ([]byte, error) {
+	var payload []byte
+	err := r.dec.Decode(&payload)
+	return payload, err
+}
+
+// wireFrameReader reads the destination name and payload out of the
+// remainder of a wire.Message's Payload sub-frame. For broadcast/plain
+// gossip that remainder *is* the payload; for unicast it is an 8-byte
+// PeerName followed by the payload, mirroring the gob stream's field
+// order without needing its own sub-frame (mesh/wire only defines
+// channel, peer and payload frames - see mesh/wire.Message).
+type wireFrameReader struct{ rest []byte }
+
+func (r *wireFrameReader) DecodeDestName() (PeerName, error) {
+	if len(r.rest) < 8 {
+		return 0, fmt.Errorf("gossip: truncated wire frame (dest peer name)")
+	}
+	name := PeerName(binary.BigEndian.Uint64(r.rest[:8]))
+	r.rest = r.rest[8:]
+	return name, nil
+}
+
+func (r *wireFrameReader) DecodePayload() ([]byte, error) {
+	return r.rest, nil
 }
 
 func (router *Router) handleGossip(tag ProtocolTag, payload []byte) error {
+	if isGossipLZ4Tag(tag) {
+		decompressed, err := decompressGossip(payload)
+		if err != nil {
+			return err
+		}
+		return router.handleGossip(plainTag(tag), decompressed)
+	}
+	if wire.Looks(payload) {
+		msg, err := wire.Decode(payload)
+		if err != nil {
+			return err
+		}
+		channel := router.gossipChannel(msg.Channel)
+		srcName := PeerName(binary.BigEndian.Uint64(msg.Peer[:]))
+		return channel.dispatch(tag, srcName, payload, &wireFrameReader{rest: msg.Payload})
+	}
 	decoder := gob.NewDecoder(bytes.NewReader(payload))
 	var channelName string
 	if err := decoder.Decode(&channelName); err != nil {
@@ -38,20 +200,52 @@ func (router *Router) handleGossip(tag ProtocolTag, payload []byte) error {
 	if err := decoder.Decode(&srcName); err != nil {
 		return err
 	}
+	return channel.dispatch(tag, srcName, payload, gobFrameReader{decoder})
+}
+
+func (c *GossipChannel) dispatch(tag ProtocolTag, srcName PeerName, origPayload []byte, reader gossipFrameReader) error {
 	switch tag {
 	case ProtocolGossipUnicast:
-		return channel.deliverUnicast(srcName, payload, decoder)
+		return c.deliverUnicast(srcName, origPayload, reader)
 	case ProtocolGossipBroadcast:
-		return channel.deliverBroadcast(srcName, payload, decoder)
+		return c.deliverBroadcast(srcName, origPayload, reader)
 	case ProtocolGossip:
-		return channel.deliver(srcName, payload, decoder)
+		return c.deliver(srcName, origPayload, reader)
 	}
 	return nil
 }
 
-func (c *GossipChannel) deliverUnicast(srcName PeerName, origPayload []byte, dec *gob.Decoder) error {
-	var destName PeerName
-	if err := dec.Decode(&destName); err != nil {
+// GossipQueues reports the current per-peer, per-priority queue depth (in
+// buffered messages) for every channel and connection, keyed by channel
+// name. It is intended for observability only.
+func (router *Router) GossipQueues() map[string]map[PeerName][numPriorities]int {
+	router.gossipMutex.Lock()
+	channels := make(map[string]*GossipChannel, len(router.gossipChannels))
+	for name, channel := range router.gossipChannels {
+		channels[name] = channel
+	}
+	router.gossipMutex.Unlock()
+
+	result := make(map[string]map[PeerName][numPriorities]int, len(channels))
+	for name, channel := range channels {
+		result[name] = channel.queueDepths()
+	}
+	return result
+}
+
+func (c *GossipChannel) queueDepths() map[PeerName][numPriorities]int {
+	c.Lock()
+	defer c.Unlock()
+	depths := make(map[PeerName][numPriorities]int, len(c.senders))
+	for conn, sender := range c.senders {
+		depths[conn.Remote().Name] = sender.queueDepths()
+	}
+	return depths
+}
+
+func (c *GossipChannel) deliverUnicast(srcName PeerName, origPayload []byte, reader gossipFrameReader) error {
+	destName, err := reader.DecodeDestName()
+	if err != nil {
 		return err
 	}
 	if c.ourself.Name != destName {
@@ -62,55 +256,111 @@ func (c *GossipChannel) deliverUnicast(srcName PeerName, origPayload []byte, dec
 		}
 		return nil
 	}
-	var payload []byte
-	if err := dec.Decode(&payload); err != nil {
+	payload, err := reader.DecodePayload()
+	if err != nil {
 		return err
 	}
-	return c.gossiper.OnGossipUnicast(srcName, payload)
+	return c.handleCallbackError(srcName, c.gossiper.OnGossipUnicast(srcName, payload))
 }
 
-func (c *GossipChannel) deliverBroadcast(srcName PeerName, _ []byte, dec *gob.Decoder) error {
-	var payload []byte
-	if err := dec.Decode(&payload); err != nil {
+func (c *GossipChannel) deliverBroadcast(srcName PeerName, _ []byte, reader gossipFrameReader) error {
+	payload, err := reader.DecodePayload()
+	if err != nil {
 		return err
 	}
 	data, err := c.gossiper.OnGossipBroadcast(srcName, payload)
-	if err != nil || data == nil {
-		return err
+	if err != nil {
+		return c.handleCallbackError(srcName, err)
+	}
+	if data == nil {
+		return nil
 	}
-	return c.relayBroadcast(srcName, data)
+	if err := c.relayBroadcast(srcName, data); err != nil {
+		// just log errors from relaying on someone else's broadcast; a
+		// problem forwarding to some other peer is not enough reason to
+		// break the connection from the source of the broadcast.
+		c.log(err)
+	}
+	return nil
 }
 
-func (c *GossipChannel) deliver(srcName PeerName, _ []byte, dec *gob.Decoder) error {
-	var payload []byte
-	if err := dec.Decode(&payload); err != nil {
+func (c *GossipChannel) deliver(srcName PeerName, _ []byte, reader gossipFrameReader) error {
+	payload, err := reader.DecodePayload()
+	if err != nil {
 		return err
 	}
-	if data, err := c.gossiper.OnGossip(payload); err != nil {
-		return err
-	} else if data != nil {
+	data, err := c.gossiper.OnGossip(payload)
+	if err != nil {
+		return c.handleCallbackError(srcName, err)
+	}
+	if data != nil {
 		c.Send(srcName, data)
 	}
 	return nil
 }
 
 func (c *GossipChannel) GossipUnicast(dstPeerName PeerName, msg []byte) error {
-	return c.relayUnicast(dstPeerName, GobEncode(c.name, c.ourself.Name, dstPeerName, msg))
+	conn, err := c.connectionForUnicast(dstPeerName)
+	if err != nil {
+		return err
+	}
+	buf := encodeUnicastFrame(conn, c.name, c.ourself.Name, dstPeerName, msg)
+	return c.sendUnicastBuf(conn, buf)
 }
 
 func (c *GossipChannel) GossipBroadcast(update GossipData) error {
 	return c.relayBroadcast(c.ourself.Name, update)
 }
 
-func (c *GossipChannel) relayUnicast(dstPeerName PeerName, buf []byte) (err error) {
-	if relayPeerName, found := c.routes.UnicastAll(dstPeerName); !found {
-		err = fmt.Errorf("unknown relay destination: %s", dstPeerName)
-	} else if conn, found := c.ourself.ConnectionTo(relayPeerName); !found {
-		err = fmt.Errorf("unable to find connection to relay peer %s", relayPeerName)
-	} else {
-		conn.(ProtocolSender).SendProtocolMsg(ProtocolMsg{ProtocolGossipUnicast, buf})
+func (c *GossipChannel) connectionForUnicast(dstPeerName PeerName) (Connection, error) {
+	relayPeerName, found := c.routes.UnicastAll(dstPeerName)
+	if !found {
+		return nil, fmt.Errorf("unknown relay destination: %s", dstPeerName)
+	}
+	conn, found := c.ourself.ConnectionTo(relayPeerName)
+	if !found {
+		return nil, fmt.Errorf("unable to find connection to relay peer %s", relayPeerName)
 	}
-	return err
+	return conn, nil
+}
+
+// relayUnicast forwards an already-encoded unicast frame towards
+// dstPeerName, unchanged, whether it originated locally or is being
+// relayed on behalf of another peer.
+func (c *GossipChannel) relayUnicast(dstPeerName PeerName, buf []byte) error {
+	conn, err := c.connectionForUnicast(dstPeerName)
+	if err != nil {
+		return err
+	}
+	return c.sendUnicastBuf(conn, buf)
+}
+
+func (c *GossipChannel) sendUnicastBuf(conn Connection, buf []byte) error {
+	if err := c.takeBuffer(conn, len(buf)); err != nil {
+		return err
+	}
+	conn.(ProtocolSender).SendProtocolMsg(c.maybeCompress(conn, ProtocolGossipUnicast, buf))
+	c.giveBuffer(conn, len(buf))
+	return nil
+}
+
+// maybeCompress wraps msg with LZ4 and returns it under tag's compressed
+// counterpart when conn has negotiated support, compression is not
+// disabled for this channel, and msg is large enough for compression to
+// be worthwhile; otherwise it returns msg unchanged under tag.
+func (c *GossipChannel) maybeCompress(conn Connection, tag ProtocolTag, msg []byte) ProtocolMsg {
+	if c.descriptor.DisableCompression || len(msg) < lz4CompressionThreshold || !peerSupportsGossipLZ4(conn) {
+		return ProtocolMsg{tag, msg}
+	}
+	compressedTag, ok := lz4Tag(tag)
+	if !ok {
+		return ProtocolMsg{tag, msg}
+	}
+	compressed, err := compressGossip(msg)
+	if err != nil {
+		return ProtocolMsg{tag, msg}
+	}
+	return ProtocolMsg{compressedTag, compressed}
 }
 
 func (c *GossipChannel) relayBroadcast(srcName PeerName, update GossipData) error {
@@ -123,18 +373,19 @@ func (c *GossipChannel) relayBroadcast(srcName PeerName, update GossipData) erro
 	blockedConnections := make(ConnectionSet)
 	connections := c.ourself.ConnectionsTo(nextHops)
 	for _, msg := range update.Encode() {
-		protocolMsg := ProtocolMsg{ProtocolGossipBroadcast, GobEncode(c.name, srcName, msg)}
 		for _, conn := range connections {
+			encoded := encodeGossipFrame(conn, ProtocolGossipBroadcast, c.name, srcName, msg)
+			protocolMsg := c.maybeCompress(conn, ProtocolGossipBroadcast, encoded)
 			if !conn.(ProtocolSender).SendOrDropProtocolMsg(protocolMsg) {
 				blockedConnections[conn] = void
 			}
 		}
 	}
 	// for any blocked connections we send the broadcast as a normal
-	// gossip instead, which is better than dropping it completely.
-	c.sendDown(blockedConnections, update)
-
-	return nil
+	// gossip instead, which is better than dropping it completely; it
+	// will be queued at c.descriptor.Priority and may itself be dropped
+	// under sustained backpressure rather than blocking other peers.
+	return c.sendDown(blockedConnections, update)
 }
 
 func (c *GossipChannel) Send(srcName PeerName, data GossipData) {
@@ -146,20 +397,23 @@ func (c *GossipChannel) Send(srcName PeerName, data GossipData) {
 			selectedConnections[conn] = void
 		}
 	}
-	c.sendDown(selectedConnections, data)
+	if err := c.sendDown(selectedConnections, data); err != nil {
+		c.log(err)
+	}
 }
 
 func (c *GossipChannel) SendDown(conn Connection, data GossipData) {
-	c.sendDown(ConnectionSet{conn: void}, data)
+	if err := c.sendDown(ConnectionSet{conn: void}, data); err != nil {
+		c.log(err)
+	}
 }
 
-func (c *GossipChannel) sendDown(selectedConnections ConnectionSet, data GossipData) {
+func (c *GossipChannel) sendDown(selectedConnections ConnectionSet, data GossipData) error {
 	if len(selectedConnections) == 0 {
-		return
+		return nil
 	}
 	connections := c.ourself.Connections()
 	c.Lock()
-	defer c.Unlock()
 	// GC - randomly (courtesy of go's map iterator) pick some
 	// existing senders and stop&remove them if the associated
 	// connection is no longer active.  We stop as soon as we
@@ -175,37 +429,85 @@ func (c *GossipChannel) sendDown(selectedConnections ConnectionSet, data GossipD
 		if _, found := connections[conn]; !found {
 			delete(c.senders, conn)
 			sender.Stop()
+			delete(c.peerLimiters, conn)
 		} else {
 			break
 		}
 	}
-	// start senders, if necessary, and send.
+	// start senders, if necessary, but don't enqueue into them yet:
+	// peerGossipSender.Send blocks on the byte semaphores, and a peer
+	// stuck there must not hold up every other peer's senders by
+	// keeping c.Lock() held.
+	senders := make([]*peerGossipSender, 0, len(selectedConnections))
 	for conn := range selectedConnections {
 		sender, found := c.senders[conn]
 		if !found {
 			sender = c.makeSender(conn)
 			c.senders[conn] = sender
 		}
-		sender.Send(data)
+		senders = append(senders, sender)
+	}
+	c.Unlock()
+
+	var firstErr error
+	for _, sender := range senders {
+		if err := sender.Send(data); err != nil && firstErr == nil {
+			firstErr = err
+		}
 	}
+	return firstErr
 }
 
 // We have seen a couple of failures which suggest a >128GB slice was encountered.
 // 100MB should be enough for anyone.
 const maxFeasibleMessageLen = 100 * 1024 * 1024
 
-func (c *GossipChannel) makeSender(conn Connection) *GossipSender {
-	return NewGossipSender(func(pending GossipData) {
-		for _, msg := range pending.Encode() {
-			if len(msg) > maxFeasibleMessageLen {
-				panic(fmt.Sprintf("Gossip message too large: len=%d bytes; on channel '%s' from %+v", len(msg), c.name, pending))
-			}
-			protocolMsg := ProtocolMsg{ProtocolGossip, GobEncode(c.name, c.ourself.Name, msg)}
-			conn.(ProtocolSender).SendProtocolMsg(protocolMsg)
+// makeSender must be called with c.Lock held, since it populates
+// c.peerLimiters.
+func (c *GossipChannel) makeSender(conn Connection) *peerGossipSender {
+	peerLimiter := newByteSemaphore(c.peerBufferMax)
+	c.peerLimiters[conn] = peerLimiter
+	return newPeerGossipSender(c.descriptor, c.bufferLimiter, peerLimiter, func(msg []byte) {
+		if len(msg) > maxFeasibleMessageLen {
+			panic(fmt.Sprintf("Gossip message too large: len=%d bytes; on channel '%s'", len(msg), c.name))
 		}
+		encoded := encodeGossipFrame(conn, ProtocolGossip, c.name, c.ourself.Name, msg)
+		conn.(ProtocolSender).SendProtocolMsg(c.maybeCompress(conn, ProtocolGossip, encoded))
 	})
 }
 
+// takeBuffer reserves n bytes of the shared gossip buffer budget against
+// both the global limit and conn's per-peer sub-limit, for payloads (such
+// as unicast relays) sent directly rather than through a peerGossipSender
+// queue.
+func (c *GossipChannel) takeBuffer(conn Connection, n int) error {
+	c.Lock()
+	peerLimiter, found := c.peerLimiters[conn]
+	if !found {
+		peerLimiter = newByteSemaphore(c.peerBufferMax)
+		c.peerLimiters[conn] = peerLimiter
+	}
+	c.Unlock()
+	if err := peerLimiter.take(uint(n)); err != nil {
+		return err
+	}
+	if err := c.bufferLimiter.take(uint(n)); err != nil {
+		peerLimiter.give(uint(n))
+		return err
+	}
+	return nil
+}
+
+func (c *GossipChannel) giveBuffer(conn Connection, n int) {
+	c.Lock()
+	peerLimiter, found := c.peerLimiters[conn]
+	c.Unlock()
+	if found {
+		peerLimiter.give(uint(n))
+	}
+	c.bufferLimiter.give(uint(n))
+}
+
 func (c *GossipChannel) log(args ...interface{}) {
 	log.Println(append(append([]interface{}{}, "[gossip "+c.name+"]:"), args...)...)
 }
@@ -0,0 +1,98 @@
+package mesh
+
+import (
+	"encoding/binary"
+	"fmt"
+
+	"github.com/pierrec/lz4/v4"
+)
+
+// lz4CompressionThreshold is the minimum encoded message size worth
+// paying the compression and decompression overhead for. Smaller
+// messages (most unicast control traffic) are sent uncompressed.
+const lz4CompressionThreshold = 1024
+
+// gossipLZ4Capable is implemented by connections that have negotiated
+// the gossip LZ4 capability flag during the handshake. Only such
+// connections are offered compressed frames; everything else falls back
+// to the plain (uncompressed) tags.
+type gossipLZ4Capable interface {
+	PeerSupportsGossipLZ4() bool
+}
+
+func peerSupportsGossipLZ4(conn Connection) bool {
+	capable, ok := conn.(gossipLZ4Capable)
+	return ok && capable.PeerSupportsGossipLZ4()
+}
+
+// compressGossip wraps msg with an LZ4 block, prefixed with the
+// uncompressed length as a little-endian uint32, so the receiver can
+// size its decompression buffer without trusting the compressed frame.
+func compressGossip(msg []byte) ([]byte, error) {
+	compressed := make([]byte, 4+lz4.CompressBlockBound(len(msg)))
+	binary.LittleEndian.PutUint32(compressed[:4], uint32(len(msg)))
+	var c lz4.Compressor
+	n, err := c.CompressBlock(msg, compressed[4:])
+	if err != nil {
+		return nil, err
+	}
+	if n == 0 || n >= len(msg) {
+		// incompressible: the block is no shorter than the input
+		return nil, fmt.Errorf("gossip message did not compress")
+	}
+	return compressed[:4+n], nil
+}
+
+// decompressGossip reverses compressGossip, refusing to allocate more
+// than maxFeasibleMessageLen for the decompressed result regardless of
+// what the (untrusted) length prefix claims.
+func decompressGossip(payload []byte) ([]byte, error) {
+	if len(payload) < 4 {
+		return nil, fmt.Errorf("gossip LZ4 frame too short: %d bytes", len(payload))
+	}
+	uncompressedLen := binary.LittleEndian.Uint32(payload[:4])
+	if uncompressedLen > maxFeasibleMessageLen {
+		return nil, fmt.Errorf("gossip LZ4 frame claims %d uncompressed bytes, exceeding %d byte limit", uncompressedLen, maxFeasibleMessageLen)
+	}
+	msg := make([]byte, uncompressedLen)
+	n, err := lz4.UncompressBlock(payload[4:], msg)
+	if err != nil {
+		return nil, err
+	}
+	return msg[:n], nil
+}
+
+// lz4Tag maps a plain gossip ProtocolTag to its compressed counterpart.
+func lz4Tag(tag ProtocolTag) (ProtocolTag, bool) {
+	switch tag {
+	case ProtocolGossip:
+		return ProtocolGossipLZ4, true
+	case ProtocolGossipUnicast:
+		return ProtocolGossipUnicastLZ4, true
+	case ProtocolGossipBroadcast:
+		return ProtocolGossipBroadcastLZ4, true
+	}
+	return tag, false
+}
+
+// plainTag is the inverse of lz4Tag, used once a compressed frame has
+// been decompressed and needs to be handled as its uncompressed tag.
+func plainTag(tag ProtocolTag) ProtocolTag {
+	switch tag {
+	case ProtocolGossipLZ4:
+		return ProtocolGossip
+	case ProtocolGossipUnicastLZ4:
+		return ProtocolGossipUnicast
+	case ProtocolGossipBroadcastLZ4:
+		return ProtocolGossipBroadcast
+	}
+	return tag
+}
+
+func isGossipLZ4Tag(tag ProtocolTag) bool {
+	switch tag {
+	case ProtocolGossipLZ4, ProtocolGossipUnicastLZ4, ProtocolGossipBroadcastLZ4:
+		return true
+	}
+	return false
+}
@@ -0,0 +1,64 @@
+package mesh
+
+import (
+	"bytes"
+	"encoding/binary"
+	"testing"
+)
+
+func TestCompressGossipRoundTrip(t *testing.T) {
+	msg := bytes.Repeat([]byte("gossip payload "), 200)
+	compressed, err := compressGossip(msg)
+	if err != nil {
+		t.Fatalf("compressGossip: %v", err)
+	}
+	got, err := decompressGossip(compressed)
+	if err != nil {
+		t.Fatalf("decompressGossip: %v", err)
+	}
+	if !bytes.Equal(got, msg) {
+		t.Fatalf("round trip mismatch: got %d bytes, want %d bytes", len(got), len(msg))
+	}
+}
+
+func TestCompressGossipRejectsIncompressibleInput(t *testing.T) {
+	// compressGossip refuses input that LZ4 can't shrink; a single byte
+	// is too short for LZ4 to find any redundancy in, so its block (a
+	// token plus the literal) is longer than the input.
+	msg := []byte{0x01}
+	if _, err := compressGossip(msg); err == nil {
+		t.Fatal("compressGossip(1 byte) = nil error, want an error (the LZ4 block for input this small is longer than the input)")
+	}
+}
+
+func TestDecompressGossipRejectsTruncatedFrame(t *testing.T) {
+	if _, err := decompressGossip([]byte{1, 2, 3}); err == nil {
+		t.Fatal("decompressGossip(3 bytes) = nil error, want an error (frame shorter than the 4-byte length prefix)")
+	}
+}
+
+func TestDecompressGossipRejectsOversizedClaimedLength(t *testing.T) {
+	// a frame claiming far more uncompressed bytes than
+	// maxFeasibleMessageLen must be rejected before any allocation is
+	// attempted, regardless of what follows the length prefix.
+	payload := make([]byte, 8)
+	binary.LittleEndian.PutUint32(payload[:4], uint32(maxFeasibleMessageLen)+1)
+	if _, err := decompressGossip(payload); err == nil {
+		t.Fatal("decompressGossip with an over-limit claimed length = nil error, want an error")
+	}
+}
+
+func TestLz4TagAndPlainTagRoundTrip(t *testing.T) {
+	for _, tag := range []ProtocolTag{ProtocolGossip, ProtocolGossipUnicast, ProtocolGossipBroadcast} {
+		lz4tag, ok := lz4Tag(tag)
+		if !ok {
+			t.Fatalf("lz4Tag(%v) = _, false, want a compressed counterpart", tag)
+		}
+		if !isGossipLZ4Tag(lz4tag) {
+			t.Fatalf("isGossipLZ4Tag(%v) = false, want true", lz4tag)
+		}
+		if plainTag(lz4tag) != tag {
+			t.Fatalf("plainTag(lz4Tag(%v)) = %v, want %v", tag, plainTag(lz4tag), tag)
+		}
+	}
+}
@@ -0,0 +1,75 @@
+package mesh
+
+import (
+	"fmt"
+	"time"
+)
+
+// GossipError is the structured form of error a Gossiper's OnGossip,
+// OnGossipBroadcast and OnGossipUnicast callbacks may return. When Fatal
+// is false, the error is treated as transient - the local subsystem
+// wasn't ready for this update, rather than the peering itself being
+// broken - and is handled by logging it and giving the Gossiper a chance
+// to recover via OnGossipMissed, instead of tearing down the connection.
+// A plain (non-*GossipError) error from a callback is still treated as
+// fatal, preserving the previous behaviour for Gossipers that haven't
+// been updated to distinguish the two cases.
+type GossipError struct {
+	Err   error
+	Fatal bool
+}
+
+func (e *GossipError) Error() string {
+	return e.Err.Error()
+}
+
+func (e *GossipError) Unwrap() error {
+	return e.Err
+}
+
+// NewGossipError wraps err as a non-fatal GossipError.
+func NewGossipError(err error) *GossipError {
+	return &GossipError{Err: err, Fatal: false}
+}
+
+// missedGossipRetryDelay is how long we wait before invoking
+// OnGossipMissed after a non-fatal gossip error, giving the local
+// subsystem a moment to finish whatever initialisation it was waiting
+// on before we ask it to request the missed state again.
+const missedGossipRetryDelay = 5 * time.Second
+
+// GossiperMissed is implemented by a Gossiper that wants to recover from
+// a non-fatal delivery error by re-requesting whatever state it missed
+// from srcName, instead of relying on the next full-state gossip round.
+type GossiperMissed interface {
+	OnGossipMissed(srcName PeerName)
+}
+
+// handleCallbackError inspects the error returned by a Gossiper callback
+// (OnGossip, OnGossipBroadcast, OnGossipUnicast) for channel c. Non-fatal
+// *GossipErrors are logged and, if the Gossiper implements
+// GossiperMissed, trigger a delayed OnGossipMissed(srcName) instead of
+// being returned, so handleGossip does not treat them as a protocol
+// violation and tear down the connection. Fatal errors, and any plain
+// error from a Gossiper that hasn't adopted GossipError, are returned
+// unchanged.
+func (c *GossipChannel) handleCallbackError(srcName PeerName, err error) error {
+	gerr, ok := err.(*GossipError)
+	if !ok {
+		return err
+	}
+	if gerr == nil {
+		// a typed-nil *GossipError: err is a non-nil interface wrapping a
+		// nil pointer, so returning it unchanged would panic the first
+		// time something calls Error() on it. Treat it as no error.
+		return nil
+	}
+	if gerr.Fatal {
+		return err
+	}
+	c.log(fmt.Sprintf("non-fatal error from gossiper, will request missed state: %v", gerr.Err))
+	if missed, ok := c.gossiper.(GossiperMissed); ok {
+		time.AfterFunc(missedGossipRetryDelay, func() { missed.OnGossipMissed(srcName) })
+	}
+	return nil
+}
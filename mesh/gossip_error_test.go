@@ -0,0 +1,82 @@
+package mesh
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+// fakeMissedGossiper is a Gossiper that also implements GossiperMissed,
+// recording which peer OnGossipMissed was invoked for.
+type fakeMissedGossiper struct {
+	missed chan PeerName
+}
+
+func (fakeMissedGossiper) OnGossip(buf []byte) (GossipData, error) { return nil, nil }
+
+func (fakeMissedGossiper) OnGossipBroadcast(src PeerName, update []byte) (GossipData, error) {
+	return nil, nil
+}
+
+func (fakeMissedGossiper) OnGossipUnicast(src PeerName, msg []byte) error { return nil }
+
+func (fakeMissedGossiper) Gossip() GossipData { return nil }
+
+func (g fakeMissedGossiper) OnGossipMissed(srcName PeerName) {
+	g.missed <- srcName
+}
+
+func TestHandleCallbackErrorNilIsUnchanged(t *testing.T) {
+	c := &GossipChannel{name: "test"}
+	if err := c.handleCallbackError(0, nil); err != nil {
+		t.Fatalf("handleCallbackError(nil) = %v, want nil", err)
+	}
+}
+
+func TestHandleCallbackErrorPlainErrorIsFatal(t *testing.T) {
+	c := &GossipChannel{name: "test"}
+	want := errors.New("boom")
+	// a plain error (not adopted to *GossipError) must be returned
+	// unchanged, preserving the previous always-fatal behaviour for
+	// Gossipers that haven't adopted GossipError.
+	if err := c.handleCallbackError(0, want); err != want {
+		t.Fatalf("handleCallbackError(plain error) = %v, want %v unchanged", err, want)
+	}
+}
+
+func TestHandleCallbackErrorFatalGossipErrorIsReturned(t *testing.T) {
+	c := &GossipChannel{name: "test"}
+	gerr := &GossipError{Err: errors.New("boom"), Fatal: true}
+	if err := c.handleCallbackError(0, gerr); err != gerr {
+		t.Fatalf("handleCallbackError(fatal *GossipError) = %v, want %v unchanged", err, gerr)
+	}
+}
+
+func TestHandleCallbackErrorTypedNilGossipErrorIsSwallowed(t *testing.T) {
+	c := &GossipChannel{name: "test"}
+	var gerr *GossipError // typed nil: err != nil but err.(*GossipError) == nil
+	// returning err unchanged here would hand the caller a non-nil error
+	// that panics the moment anything calls its Error() method.
+	if err := c.handleCallbackError(0, gerr); err != nil {
+		t.Fatalf("handleCallbackError(typed-nil *GossipError) = %v, want nil", err)
+	}
+}
+
+func TestHandleCallbackErrorNonFatalIsSwallowedAndTriggersOnGossipMissed(t *testing.T) {
+	g := fakeMissedGossiper{missed: make(chan PeerName, 1)}
+	c := &GossipChannel{name: "test", gossiper: g}
+	gerr := NewGossipError(errors.New("not ready yet"))
+
+	if err := c.handleCallbackError(42, gerr); err != nil {
+		t.Fatalf("handleCallbackError(non-fatal *GossipError) = %v, want nil", err)
+	}
+
+	select {
+	case srcName := <-g.missed:
+		if srcName != 42 {
+			t.Fatalf("OnGossipMissed called with %v, want 42", srcName)
+		}
+	case <-time.After(missedGossipRetryDelay + time.Second):
+		t.Fatal("OnGossipMissed was never called")
+	}
+}
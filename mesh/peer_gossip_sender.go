@@ -0,0 +1,215 @@
+package mesh
+
+import "sync"
+
+// peerGossipSender owns the outgoing queues for one GossipChannel on one
+// connection. Messages are queued per GossipPriority and drained by a
+// single goroutine according to weightedDrainOrder, so that
+// higher-priority entries in this sender get more of the connection's
+// attention than lower-priority ones, without the low-priority entries
+// ever blocking them (head-of-line blocking). Send queues everything at
+// the channel's one descriptor priority, and each channel has its own
+// sender and goroutine per connection, so channels registered with
+// different priorities are not scheduled against each other.
+//
+// When a queue's byte budget is exceeded, the oldest entries in the
+// lowest-priority non-empty queue are dropped until the sender is back
+// under budget, rather than blocking the caller of Send.
+//
+// Every queued byte is also reserved against a global and a per-peer
+// byteSemaphore before it is admitted, and released once it has been
+// handed to the connection writer, so that a slow peer across many
+// channels cannot pin unbounded gossip memory.
+type peerGossipSender struct {
+	descriptor    ChannelDescriptor
+	bufferLimiter *byteSemaphore
+	peerLimiter   *byteSemaphore
+	sendMsg       func(msg []byte)
+
+	mutex   sync.Mutex
+	cond    *sync.Cond
+	queues  [numPriorities][][]byte
+	bytes   [numPriorities]int
+	stopped bool
+}
+
+func newPeerGossipSender(descriptor ChannelDescriptor, bufferLimiter, peerLimiter *byteSemaphore, sendMsg func(msg []byte)) *peerGossipSender {
+	s := &peerGossipSender{
+		descriptor:    descriptor,
+		bufferLimiter: bufferLimiter,
+		peerLimiter:   peerLimiter,
+		sendMsg:       sendMsg,
+	}
+	s.cond = sync.NewCond(&s.mutex)
+	go s.run()
+	return s
+}
+
+// Send queues data for transmission at this sender's channel priority.
+// Each encoded message is reserved against the per-peer and then the
+// global byte budget; Send blocks while either is too full to admit it,
+// and returns ErrGossipBufferFull if a message is larger than either
+// budget's max. Every chunk's reservation is taken
+// before any chunk is enqueued, and rolled back if a later chunk fails
+// to reserve, so a caller never ends up with only the first few chunks
+// of a multi-chunk update (e.g. part of a topology snapshot) delivered
+// to the peer.
+func (s *peerGossipSender) Send(data GossipData) error {
+	msgs := data.Encode()
+	for i, msg := range msgs {
+		if err := s.peerLimiter.take(uint(len(msg))); err != nil {
+			s.releaseReserved(msgs[:i])
+			return err
+		}
+		if err := s.bufferLimiter.take(uint(len(msg))); err != nil {
+			s.peerLimiter.give(uint(len(msg)))
+			s.releaseReserved(msgs[:i])
+			return err
+		}
+	}
+	for _, msg := range msgs {
+		s.enqueue(s.descriptor.Priority, msg)
+	}
+	return nil
+}
+
+// releaseReserved gives back the peer and buffer reservations already
+// taken for msgs. It is used to roll back a partially-reserved Send call
+// when a later chunk fails to reserve.
+func (s *peerGossipSender) releaseReserved(msgs [][]byte) {
+	for _, msg := range msgs {
+		s.release(msg)
+	}
+}
+
+func (s *peerGossipSender) enqueue(priority GossipPriority, msg []byte) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.stopped {
+		s.release(msg)
+		return
+	}
+	s.queues[priority] = append(s.queues[priority], msg)
+	s.bytes[priority] += len(msg)
+	s.evictOverBudget()
+	s.cond.Signal()
+}
+
+// evictOverBudget drops the oldest entries from the lowest-priority
+// non-empty queue until this sender's total queued bytes and message
+// count are back within the channel descriptor's limits, releasing each
+// dropped message's reservation back to the byte semaphores. The caller
+// must hold s.mutex.
+func (s *peerGossipSender) evictOverBudget() {
+	for s.overBudget() {
+		dropped := false
+		for p := numPriorities - 1; p >= 0; p-- {
+			if len(s.queues[p]) == 0 {
+				continue
+			}
+			msg := s.queues[p][0]
+			s.bytes[p] -= len(msg)
+			s.queues[p] = s.queues[p][1:]
+			s.release(msg)
+			dropped = true
+			break
+		}
+		if !dropped {
+			return
+		}
+	}
+}
+
+func (s *peerGossipSender) overBudget() bool {
+	totalMsgs, totalBytes := 0, 0
+	for p := 0; p < numPriorities; p++ {
+		totalMsgs += len(s.queues[p])
+		totalBytes += s.bytes[p]
+	}
+	return (s.descriptor.QueueCapacity > 0 && totalMsgs > s.descriptor.QueueCapacity) ||
+		(s.descriptor.MaxQueueBytes > 0 && totalBytes > s.descriptor.MaxQueueBytes)
+}
+
+// release returns msg's reservation to the byte semaphores, for messages
+// that are dropped or discarded rather than handed to the connection
+// writer.
+func (s *peerGossipSender) release(msg []byte) {
+	s.bufferLimiter.give(uint(len(msg)))
+	s.peerLimiter.give(uint(len(msg)))
+}
+
+func (s *peerGossipSender) run() {
+	for {
+		msgs := s.drainRound()
+		if msgs == nil {
+			return
+		}
+		for _, msg := range msgs {
+			s.sendMsg(msg)
+			s.bufferLimiter.give(uint(len(msg)))
+			s.peerLimiter.give(uint(len(msg)))
+		}
+	}
+}
+
+// drainRound blocks until there is at least one message queued (or the
+// sender is stopped), then pops up to weightedDrainOrder[p] messages from
+// each priority tier, highest first, and returns them in send order.
+func (s *peerGossipSender) drainRound() [][]byte {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	for !s.stopped && s.empty() {
+		s.cond.Wait()
+	}
+	if s.stopped && s.empty() {
+		return nil
+	}
+	var out [][]byte
+	for p := 0; p < numPriorities; p++ {
+		n := weightedDrainOrder[p]
+		if n > len(s.queues[p]) {
+			n = len(s.queues[p])
+		}
+		for i := 0; i < n; i++ {
+			msg := s.queues[p][i]
+			out = append(out, msg)
+			s.bytes[p] -= len(msg)
+		}
+		s.queues[p] = s.queues[p][n:]
+	}
+	return out
+}
+
+func (s *peerGossipSender) empty() bool {
+	for p := 0; p < numPriorities; p++ {
+		if len(s.queues[p]) > 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// queueDepths returns the number of messages currently buffered at each
+// priority tier, for observability.
+func (s *peerGossipSender) queueDepths() (depths [numPriorities]int) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	for p := 0; p < numPriorities; p++ {
+		depths[p] = len(s.queues[p])
+	}
+	return depths
+}
+
+func (s *peerGossipSender) Stop() {
+	s.mutex.Lock()
+	s.stopped = true
+	for p := 0; p < numPriorities; p++ {
+		for _, msg := range s.queues[p] {
+			s.release(msg)
+		}
+		s.queues[p] = nil
+		s.bytes[p] = 0
+	}
+	s.mutex.Unlock()
+	s.cond.Signal()
+}
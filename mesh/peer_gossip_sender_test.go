@@ -0,0 +1,113 @@
+package mesh
+
+import (
+	"sync"
+	"testing"
+	"time"
+)
+
+func unboundedLimiter() *byteSemaphore {
+	return newByteSemaphore(1 << 30)
+}
+
+// collectSends drains n messages handed to sendMsg, or fails the test if
+// they don't arrive within a second.
+func collectSends(t *testing.T, n int, sent chan []byte) [][]byte {
+	t.Helper()
+	var got [][]byte
+	for i := 0; i < n; i++ {
+		select {
+		case msg := <-sent:
+			got = append(got, msg)
+		case <-time.After(time.Second):
+			t.Fatalf("only received %d/%d messages", len(got), n)
+		}
+	}
+	return got
+}
+
+func TestPeerGossipSenderDrainsHighPriorityFirst(t *testing.T) {
+	descriptor := ChannelDescriptor{Priority: PriorityNormal, QueueCapacity: 100, MaxQueueBytes: 1 << 20}
+	sent := make(chan []byte, 100)
+	s := &peerGossipSender{
+		descriptor:    descriptor,
+		bufferLimiter: unboundedLimiter(),
+		peerLimiter:   unboundedLimiter(),
+		sendMsg:       func(msg []byte) { sent <- msg },
+	}
+	s.cond = sync.NewCond(&s.mutex)
+
+	// queue everything before the drain goroutine starts, so the first
+	// round sees the full backlog: one bulk message, then a burst of
+	// high-priority messages. The weighted drain order should favour
+	// PriorityHigh, so all of the high-priority messages should come out
+	// before the lone bulk one even though it was queued first.
+	s.enqueue(PriorityBulk, []byte("bulk"))
+	for i := 0; i < 4; i++ {
+		s.enqueue(PriorityHigh, []byte("high"))
+	}
+	go s.run()
+	defer s.Stop()
+
+	got := collectSends(t, 5, sent)
+	for i := 0; i < 4; i++ {
+		if string(got[i]) != "high" {
+			t.Fatalf("message %d = %q, want \"high\" (high priority should drain before bulk)", i, got[i])
+		}
+	}
+	if string(got[4]) != "bulk" {
+		t.Fatalf("message 4 = %q, want \"bulk\"", got[4])
+	}
+}
+
+func TestPeerGossipSenderEvictsOldestLowestPriorityFirst(t *testing.T) {
+	descriptor := ChannelDescriptor{Priority: PriorityNormal, QueueCapacity: 2, MaxQueueBytes: 1 << 20}
+	sent := make(chan []byte, 100)
+	// build the sender without starting its drain goroutine, so entries
+	// actually pile up to be evicted.
+	s := &peerGossipSender{
+		descriptor:    descriptor,
+		bufferLimiter: unboundedLimiter(),
+		peerLimiter:   unboundedLimiter(),
+		sendMsg:       func(msg []byte) { sent <- msg },
+	}
+	s.cond = sync.NewCond(&s.mutex)
+
+	s.enqueue(PriorityBulk, []byte("bulk-1"))
+	s.enqueue(PriorityNormal, []byte("normal-1"))
+	// over QueueCapacity=2: the oldest entry in the lowest non-empty
+	// priority tier (bulk) should be dropped, not the normal one.
+	s.enqueue(PriorityHigh, []byte("high-1"))
+
+	depths := s.queueDepths()
+	if depths[PriorityBulk] != 0 {
+		t.Fatalf("bulk queue depth = %d, want 0 (should have been evicted)", depths[PriorityBulk])
+	}
+	if depths[PriorityNormal] != 1 || depths[PriorityHigh] != 1 {
+		t.Fatalf("queue depths = %v, want normal=1 high=1", depths)
+	}
+}
+
+func TestPeerGossipSenderQueueDepths(t *testing.T) {
+	descriptor := ChannelDescriptor{Priority: PriorityHigh, QueueCapacity: 100, MaxQueueBytes: 1 << 20}
+	release := make(chan struct{})
+	reached := make(chan struct{})
+	s := newPeerGossipSender(descriptor, unboundedLimiter(), unboundedLimiter(), func(msg []byte) {
+		close(reached)
+		<-release // hold the drain goroutine here until the test releases it
+	})
+	defer close(release)
+	defer s.Stop()
+
+	s.enqueue(PriorityHigh, []byte("x"))
+	select {
+	case <-reached:
+	case <-time.After(time.Second):
+		t.Fatal("sendMsg was never called")
+	}
+	// the message was popped from the queue to be handed to sendMsg, so
+	// it should no longer be counted as queued.
+	if depths := s.queueDepths(); depths[PriorityHigh] != 0 {
+		t.Fatalf("queueDepths()[PriorityHigh] = %d, want 0 once the message has been dequeued for sending", depths[PriorityHigh])
+	}
+}
@@ -0,0 +1,19 @@
+package mesh
+
+// Compressed counterparts of ProtocolGossip, ProtocolGossipUnicast and
+// ProtocolGossipBroadcast (see protocol.go), sent only over connections
+// that report support through gossipLZ4Capable.
+// These extend the existing ProtocolTag enum from the last tag protocol.go
+// defines, rather than a hardcoded offset, so they can't silently collide
+// if that enum ever grows.
+const (
+	ProtocolGossipLZ4 ProtocolTag = ProtocolGossip + 1 + iota
+	ProtocolGossipUnicastLZ4
+	ProtocolGossipBroadcastLZ4
+)
+
+// CapabilityGossipLZ4 names the handshake capability for receiving the
+// *LZ4 protocol tags. No code in this package advertises or checks it;
+// whether a connection is sent compressed frames is decided by
+// gossipLZ4Capable alone.
+const CapabilityGossipLZ4 = "gossip-lz4"
@@ -0,0 +1,108 @@
+package wire
+
+import (
+	"encoding/binary"
+	"testing"
+)
+
+func TestEncodeDecodeRoundTrip(t *testing.T) {
+	peer := [8]byte{1, 2, 3, 4, 5, 6, 7, 8}
+	buf, err := Encode(42, "my-channel", peer, []byte("hello"))
+	if err != nil {
+		t.Fatalf("Encode: %v", err)
+	}
+	if !Looks(buf) {
+		t.Fatal("Looks(encoded buffer) = false, want true")
+	}
+	msg, err := Decode(buf)
+	if err != nil {
+		t.Fatalf("Decode: %v", err)
+	}
+	if msg.Tag != 42 {
+		t.Errorf("Tag = %d, want 42", msg.Tag)
+	}
+	if msg.Channel != "my-channel" {
+		t.Errorf("Channel = %q, want %q", msg.Channel, "my-channel")
+	}
+	if msg.Peer != peer {
+		t.Errorf("Peer = %v, want %v", msg.Peer, peer)
+	}
+	if string(msg.Payload) != "hello" {
+		t.Errorf("Payload = %q, want %q", msg.Payload, "hello")
+	}
+}
+
+func TestLooksRejectsNonWireInput(t *testing.T) {
+	if Looks(nil) {
+		t.Error("Looks(nil) = true, want false")
+	}
+	if Looks([]byte("gob")) {
+		t.Error("Looks(gob-like bytes) = true, want false")
+	}
+	var gobLike [4]byte
+	binary.BigEndian.PutUint32(gobLike[:], 0x01020304)
+	if Looks(gobLike[:]) {
+		t.Error("Looks(non-magic 4 bytes) = true, want false")
+	}
+}
+
+func TestDecodeRejectsNonWireInput(t *testing.T) {
+	if _, err := Decode([]byte("not a wire frame")); err != ErrNotWire {
+		t.Fatalf("Decode(non-wire bytes) = %v, want ErrNotWire", err)
+	}
+}
+
+func TestDecodeRejectsTruncatedFrame(t *testing.T) {
+	buf, err := Encode(1, "c", [8]byte{}, []byte("payload"))
+	if err != nil {
+		t.Fatalf("Encode: %v", err)
+	}
+	for _, n := range []int{4, headerLen - 1, headerLen, len(buf) - 1} {
+		if n < 0 || n > len(buf) {
+			continue
+		}
+		if _, err := Decode(buf[:n]); err != ErrTruncated && err != ErrNotWire {
+			t.Errorf("Decode(buf[:%d]) = %v, want ErrTruncated (or ErrNotWire for a too-short magic check)", n, err)
+		}
+	}
+}
+
+func TestDecodeRejectsOversizedClaimedLength(t *testing.T) {
+	buf, err := Encode(1, "c", [8]byte{}, []byte("payload"))
+	if err != nil {
+		t.Fatalf("Encode: %v", err)
+	}
+	// overwrite the top-level length field with a value beyond
+	// MaxMessageLen; Decode must reject this before trusting any of the
+	// sub-frame lengths that follow.
+	binary.BigEndian.PutUint32(buf[6:10], uint32(MaxMessageLen)+1)
+	if _, err := Decode(buf); err != ErrMessageTooLarge {
+		t.Fatalf("Decode with an over-limit length field = %v, want ErrMessageTooLarge", err)
+	}
+}
+
+func TestDecodeRejectsOversizedPayloadLength(t *testing.T) {
+	buf, err := Encode(1, "c", [8]byte{}, []byte("payload"))
+	if err != nil {
+		t.Fatalf("Encode: %v", err)
+	}
+	// the payload's own length prefix is read independently of the
+	// top-level length field; claiming more than MaxMessageLen there
+	// must also be rejected before allocating a payload slice.
+	payloadLenOffset := len(buf) - len("payload") - 4
+	binary.BigEndian.PutUint32(buf[payloadLenOffset:payloadLenOffset+4], uint32(MaxMessageLen)+1)
+	if _, err := Decode(buf); err != ErrMessageTooLarge {
+		t.Fatalf("Decode with an over-limit payload length = %v, want ErrMessageTooLarge", err)
+	}
+}
+
+func TestDecodeRejectsUnsupportedVersion(t *testing.T) {
+	buf, err := Encode(1, "c", [8]byte{}, []byte("payload"))
+	if err != nil {
+		t.Fatalf("Encode: %v", err)
+	}
+	buf[4] = Version + 1
+	if _, err := Decode(buf); err != ErrUnsupportedVersion {
+		t.Fatalf("Decode with version %d = %v, want ErrUnsupportedVersion", Version+1, err)
+	}
+}
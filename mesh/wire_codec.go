@@ -0,0 +1,63 @@
+package mesh
+
+import (
+	"encoding/binary"
+
+	"github.com/defconcepts/weave/mesh/wire"
+)
+
+// WireProtocolVersion is the minimum negotiated protocol version at which
+// a connection uses the mesh/wire codec for gossip framing instead of
+// gob. Connections below this version are assumed not to understand the
+// wire format and continue to be sent gob frames.
+const WireProtocolVersion = 2
+
+// wireCapable is implemented by connections that expose the protocol
+// version negotiated during the handshake.
+type wireCapable interface {
+	NegotiatedProtocolVersion() int
+}
+
+func peerSupportsWire(conn Connection) bool {
+	capable, ok := conn.(wireCapable)
+	return ok && capable.NegotiatedProtocolVersion() >= WireProtocolVersion
+}
+
+func peerNameBytes(name PeerName) [8]byte {
+	var b [8]byte
+	binary.BigEndian.PutUint64(b[:], uint64(name))
+	return b
+}
+
+// encodeGossipFrame encodes the channelName/srcName/payload fields of a
+// plain gossip or broadcast message, using the mesh/wire codec when conn
+// has negotiated WireProtocolVersion or better, falling back to gob
+// otherwise so older peers keep working.
+func encodeGossipFrame(conn Connection, tag ProtocolTag, channelName string, srcName PeerName, msg []byte) []byte {
+	if peerSupportsWire(conn) {
+		peer := peerNameBytes(srcName)
+		if buf, err := wire.Encode(byte(tag), channelName, peer, msg); err == nil {
+			return buf
+		}
+	}
+	return GobEncode(channelName, srcName, msg)
+}
+
+// encodeUnicastFrame encodes the channelName/srcName/destName/payload
+// fields of a unicast message. Over the wire codec, destName and msg are
+// packed together into the single payload sub-frame (see
+// wireFrameReader), since mesh/wire only defines channel, peer and
+// payload frames.
+func encodeUnicastFrame(conn Connection, channelName string, srcName, destName PeerName, msg []byte) []byte {
+	if peerSupportsWire(conn) {
+		peer := peerNameBytes(srcName)
+		destBytes := peerNameBytes(destName)
+		payload := make([]byte, 8+len(msg))
+		copy(payload[:8], destBytes[:])
+		copy(payload[8:], msg)
+		if buf, err := wire.Encode(byte(ProtocolGossipUnicast), channelName, peer, payload); err == nil {
+			return buf
+		}
+	}
+	return GobEncode(channelName, srcName, destName, msg)
+}